@@ -0,0 +1,210 @@
+package pgks
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// decryptRow turns a raw (data, enc_dek, enc_nonce) row into the private key
+// it stores, unwrapping the envelope with enc when enc_dek is non-nil.
+func decryptRow(ctx context.Context, enc Encrypter, name string, data, encDEK, encNonce []byte) (ci.PrivKey, error) {
+	if encDEK == nil {
+		return ci.UnmarshalPrivateKey(data)
+	}
+	if enc == nil {
+		return nil, fmt.Errorf("pgks: key %q is encrypted but no Encrypter is configured", name)
+	}
+	plaintext, err := openPrivateKey(ctx, enc, data, encNonce, encDEK, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting key %q: %w", name, err)
+	}
+	return ci.UnmarshalPrivateKey(plaintext)
+}
+
+// Rewrap re-encrypts every encrypted row's data-encryption-key under
+// newEnc, for key-rotation events such as moving to a new KMS key. Rows
+// that were never encrypted (enc_dek IS NULL) are left untouched. k keeps
+// using newEnc for subsequent Put/Get calls once rewrapping succeeds.
+func (k *PGKeystore) Rewrap(ctx context.Context, newEnc Encrypter) error {
+	if k.encrypter == nil {
+		return errors.New("pgks: keystore was not configured with an Encrypter")
+	}
+
+	rows, err := k.pool.Query(ctx, fmt.Sprintf("SELECT key_id, name, enc_dek FROM %s WHERE enc_dek IS NOT NULL", k.table))
+	if err != nil {
+		return err
+	}
+	type wrappedRow struct {
+		keyID  string
+		name   string
+		encDEK []byte
+	}
+	var toRewrap []wrappedRow
+	for rows.Next() {
+		var r wrappedRow
+		if err := rows.Scan(&r.keyID, &r.name, &r.encDEK); err != nil {
+			rows.Close()
+			return err
+		}
+		toRewrap = append(toRewrap, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	newKEKID := kekIDFor(newEnc)
+	for _, r := range toRewrap {
+		aad := []byte(r.name)
+		dek, err := k.encrypter.Decrypt(ctx, r.encDEK, aad)
+		if err != nil {
+			return fmt.Errorf("unwrapping DEK for %q: %w", r.name, err)
+		}
+		wrappedDEK, err := newEnc.Encrypt(ctx, dek, aad)
+		if err != nil {
+			return fmt.Errorf("wrapping DEK for %q: %w", r.name, err)
+		}
+		// Scoped by key_id, not name: Rotate lets multiple versions share a
+		// name, and each has its own DEK wrapping its own row's data.
+		sql := fmt.Sprintf("UPDATE %s SET enc_dek = $1, enc_kek_id = $2 WHERE key_id = $3::uuid", k.table)
+		if _, err := k.pool.Exec(ctx, sql, wrappedDEK, newKEKID, r.keyID); err != nil {
+			return fmt.Errorf("updating %q: %w", r.name, err)
+		}
+	}
+
+	k.encrypter = newEnc
+	return nil
+}
+
+// Encrypter wraps and unwraps data-encryption-keys (DEKs) so that private
+// keys can be stored at rest under envelope encryption instead of as
+// plaintext BYTEA. Implementations are expected to be safe for concurrent
+// use.
+type Encrypter interface {
+	Encrypt(ctx context.Context, plaintext, aad []byte) (ciphertext []byte, err error)
+	Decrypt(ctx context.Context, ciphertext, aad []byte) (plaintext []byte, err error)
+}
+
+// kekIdentifier is an optional extension of Encrypter that reports a stable
+// identifier for the key-encryption-key it wraps DEKs with. It is recorded
+// alongside each row as enc_kek_id. Rewrap does not filter on it: it rewraps
+// every encrypted row, whatever KEK id the row records.
+type kekIdentifier interface {
+	KEKID() string
+}
+
+// kekIDFor returns the identifier to store for rows wrapped under enc, using
+// "default" when enc doesn't report one of its own.
+func kekIDFor(enc Encrypter) string {
+	if id, ok := enc.(kekIdentifier); ok {
+		return id.KEKID()
+	}
+	return "default"
+}
+
+// aesGCMEncrypter is a local-key Encrypter backed by AES-GCM.
+type aesGCMEncrypter struct {
+	aead cipher.AEAD
+}
+
+// WithAESGCM configures the keystore to envelope-encrypt private keys with a
+// locally held AES-GCM key. key must be 16, 24 or 32 bytes long, selecting
+// AES-128, AES-192 or AES-256 respectively.
+func WithAESGCM(key []byte) Option {
+	return func(o *Options) error {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("pgks: invalid AES-GCM key: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		o.Encrypter = aesGCMEncrypter{aead: aead}
+		return nil
+	}
+}
+
+// WithKMSEncrypter configures the keystore to envelope-encrypt private keys
+// with an externally managed Encrypter, e.g. one backed by a cloud KMS.
+func WithKMSEncrypter(enc Encrypter) Option {
+	return func(o *Options) error {
+		o.Encrypter = enc
+		return nil
+	}
+}
+
+func (e aesGCMEncrypter) KEKID() string { return "aesgcm-local" }
+
+func (e aesGCMEncrypter) Encrypt(_ context.Context, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return append(nonce, e.aead.Seal(nil, nonce, plaintext, aad)...), nil
+}
+
+func (e aesGCMEncrypter) Decrypt(_ context.Context, ciphertext, aad []byte) ([]byte, error) {
+	ns := e.aead.NonceSize()
+	if len(ciphertext) < ns {
+		return nil, errors.New("pgks: wrapped DEK is shorter than the AES-GCM nonce")
+	}
+	nonce, ct := ciphertext[:ns], ciphertext[ns:]
+	return e.aead.Open(nil, nonce, ct, aad)
+}
+
+// sealPrivateKey generates a random 32-byte DEK, encrypts plaintext under it
+// with AES-GCM (using aad to bind the ciphertext to e.g. the key name), and
+// wraps the DEK with enc. It returns the sealed private key, the nonce used
+// to seal it, and the wrapped DEK, all ready to store alongside each other.
+func sealPrivateKey(ctx context.Context, enc Encrypter, plaintext, aad []byte) (ciphertext, nonce, wrappedDEK []byte, err error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, nil, err
+	}
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	ciphertext = aead.Seal(nil, nonce, plaintext, aad)
+	wrappedDEK, err = enc.Encrypt(ctx, dek, aad)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("wrapping DEK: %w", err)
+	}
+	return ciphertext, nonce, wrappedDEK, nil
+}
+
+// openPrivateKey reverses sealPrivateKey: it unwraps the DEK with enc and
+// uses it to open ciphertext, verifying aad (e.g. the key name) matches what
+// was used to seal it. A mismatched aad — including one from a different
+// key's row — fails decryption rather than silently returning the wrong key.
+func openPrivateKey(ctx context.Context, enc Encrypter, ciphertext, nonce, wrappedDEK, aad []byte) ([]byte, error) {
+	dek, err := enc.Decrypt(ctx, wrappedDEK, aad)
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping DEK: %w", err)
+	}
+	block, err := aes.NewCipher(dek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
@@ -5,15 +5,29 @@ import (
 	"errors"
 	"fmt"
 	ks "github.com/ipfs/go-ipfs-keystore"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	ci "github.com/libp2p/go-libp2p-core/crypto"
+	"time"
 )
 
+// dbtx is satisfied by both *pgxpool.Pool and pgx.Tx, letting the query
+// helpers below run unmodified whether or not they're inside an explicit
+// transaction (see View and Update).
+type dbtx interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
 // PGKeystore is a PostgreSQL backed keystore.
 type PGKeystore struct {
-	table string
-	pool  *pgxpool.Pool
+	table         string
+	pool          *pgxpool.Pool
+	encrypter     Encrypter
+	borrowedPool  bool
+	updateRetries int
 }
 
 // NewKeystore creates a new PostgreSQL datastore
@@ -29,7 +43,40 @@ func NewKeystore(ctx context.Context, connString string, options ...Option) (*PG
 		return nil, err
 	}
 
-	return &PGKeystore{table: cfg.Table, pool: pool}, nil
+	if cfg.AutoMigrate {
+		if err := Migrate(ctx, pool, cfg.QualifiedTable()); err != nil {
+			pool.Close()
+			return nil, err
+		}
+	}
+
+	return &PGKeystore{table: cfg.QualifiedTable(), pool: pool, encrypter: cfg.Encrypter, updateRetries: cfg.UpdateRetries}, nil
+}
+
+// NewKeystoreWithPool creates a new PGKeystore backed by an externally
+// managed pool, e.g. one already configured with custom tracelog,
+// AfterConnect, TLS or connection-limit settings. The keystore does not
+// take ownership of pool: Close will not close it, since the caller is
+// responsible for its lifecycle.
+func NewKeystoreWithPool(ctx context.Context, pool *pgxpool.Pool, options ...Option) (*PGKeystore, error) {
+	cfg := Options{}
+	if err := cfg.Apply(append([]Option{OptionDefaults}, options...)...); err != nil {
+		return nil, err
+	}
+
+	if cfg.AutoMigrate {
+		if err := Migrate(ctx, pool, cfg.QualifiedTable()); err != nil {
+			return nil, err
+		}
+	}
+
+	return &PGKeystore{
+		table:         cfg.QualifiedTable(),
+		pool:          pool,
+		encrypter:     cfg.Encrypter,
+		borrowedPool:  true,
+		updateRetries: cfg.UpdateRetries,
+	}, nil
 }
 
 // PgxPool exposes the underlying pool of connections to Postgres.
@@ -37,17 +84,27 @@ func (k *PGKeystore) PgxPool() *pgxpool.Pool {
 	return k.pool
 }
 
-// Close closes the underying PostgreSQL database.
+// Close closes the underying PostgreSQL database, unless the pool was
+// supplied via NewKeystoreWithPool, in which case the caller owns it.
 func (k *PGKeystore) Close() error {
-	if k.pool != nil {
+	if k.pool != nil && !k.borrowedPool {
 		k.pool.Close()
 	}
 	return nil
 }
 
 func (k *PGKeystore) Has(name string) (bool, error) {
-	sql := fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE name = $1)", k.table)
-	row := k.pool.QueryRow(context.Background(), sql, name)
+	return k.HasCtx(context.Background(), name)
+}
+
+// HasCtx is the context-aware variant of Has.
+func (k *PGKeystore) HasCtx(ctx context.Context, name string) (bool, error) {
+	return hasKey(ctx, k.pool, k.table, name)
+}
+
+func hasKey(ctx context.Context, db dbtx, table, name string) (bool, error) {
+	sql := fmt.Sprintf("SELECT exists(SELECT 1 FROM %s WHERE name = $1 AND retired_at IS NULL)", table)
+	row := db.QueryRow(ctx, sql, name)
 	var exists bool
 	switch err := row.Scan(&exists); err {
 	case pgx.ErrNoRows:
@@ -61,39 +118,59 @@ func (k *PGKeystore) Has(name string) (bool, error) {
 
 // Put stores a key in the Keystore, if a key with the same name already exists, returns ErrKeyExists
 func (k *PGKeystore) Put(name string, priv ci.PrivKey) error {
+	return k.PutCtx(context.Background(), name, priv)
+}
+
+// PutCtx is the context-aware variant of Put.
+func (k *PGKeystore) PutCtx(ctx context.Context, name string, priv ci.PrivKey) error {
+	skbytes, err := marshalNewKey(ctx, k.pool, k.table, name, priv)
+	if err != nil {
+		return err
+	}
+	return insertKey(ctx, k.pool, k.table, k.encrypter, name, skbytes, keyRow{Version: 1, CreatedAt: time.Now()})
+}
+
+// marshalNewKey validates name, checks it isn't already taken, and
+// marshals priv, the shared first half of every Put-like operation.
+func marshalNewKey(ctx context.Context, db dbtx, table, name string, priv ci.PrivKey) ([]byte, error) {
 	if name == "" {
-		return fmt.Errorf("key name must be at least one character")
+		return nil, fmt.Errorf("key name must be at least one character")
 	}
-	exists, err := k.Has(name)
+	exists, err := hasKey(ctx, db, table, name)
 	if exists {
-		return ks.ErrKeyExists
+		return nil, ks.ErrKeyExists
 	}
 	if err != nil && !errors.Is(err, ks.ErrNoSuchKey) {
-		return err
-	}
-	skbytes, err := ci.MarshalPrivateKey(priv)
-	if err != nil {
-		return err
-	}
-	sql := fmt.Sprintf("INSERT INTO %s (name, data) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET data = $2", k.table)
-	_, err = k.pool.Exec(context.Background(), sql, name, skbytes)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return ci.MarshalPrivateKey(priv)
 }
 
 // Get retrieves a key from the Keystore if it exists, and returns ErrNoSuchKey
 // otherwise.
 func (k *PGKeystore) Get(name string) (ci.PrivKey, error) {
-	sql := fmt.Sprintf("SELECT data FROM %s WHERE name = $1", k.table)
-	row := k.pool.QueryRow(context.Background(), sql, name)
-	var out []byte
-	switch err := row.Scan(&out); err {
+	return k.GetCtx(context.Background(), name)
+}
+
+// GetCtx is the context-aware variant of Get. When name has been rotated to
+// multiple versions, it returns the highest-version row that hasn't been
+// retired.
+func (k *PGKeystore) GetCtx(ctx context.Context, name string) (ci.PrivKey, error) {
+	return getKey(ctx, k.pool, k.table, k.encrypter, name)
+}
+
+func getKey(ctx context.Context, db dbtx, table string, enc Encrypter, name string) (ci.PrivKey, error) {
+	sql := fmt.Sprintf(
+		"SELECT data, enc_dek, enc_nonce FROM %s WHERE name = $1 AND retired_at IS NULL ORDER BY version DESC LIMIT 1",
+		table,
+	)
+	row := db.QueryRow(ctx, sql, name)
+	var data, encDEK, encNonce []byte
+	switch err := row.Scan(&data, &encDEK, &encNonce); err {
 	case pgx.ErrNoRows:
 		return nil, ks.ErrNoSuchKey
 	case nil:
-		return ci.UnmarshalPrivateKey(out)
+		return decryptRow(ctx, enc, name, data, encDEK, encNonce)
 	default:
 		return nil, err
 	}
@@ -101,21 +178,37 @@ func (k *PGKeystore) Get(name string) (ci.PrivKey, error) {
 
 // Delete removes a key from the Keystore
 func (k *PGKeystore) Delete(name string) error {
-	sql := fmt.Sprintf("DELETE FROM %s WHERE name = $1", k.table)
-	_, err := k.pool.Exec(context.Background(), sql, name)
-	if err != nil {
-		return err
-	}
-	return nil
+	return k.DeleteCtx(context.Background(), name)
+}
+
+// DeleteCtx is the context-aware variant of Delete.
+func (k *PGKeystore) DeleteCtx(ctx context.Context, name string) error {
+	return deleteKey(ctx, k.pool, k.table, name)
+}
+
+func deleteKey(ctx context.Context, db dbtx, table, name string) error {
+	_, err := db.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE name = $1", table), name)
+	return err
 }
 
 // List returns a list of key identifier
 func (k *PGKeystore) List() ([]string, error) {
-	sql := fmt.Sprintf("SELECT name FROM %s", k.table)
-	rows, err := k.pool.Query(context.Background(), sql)
+	return k.ListCtx(context.Background())
+}
+
+// ListCtx is the context-aware variant of List.
+func (k *PGKeystore) ListCtx(ctx context.Context) ([]string, error) {
+	return listKeys(ctx, k.pool, k.table)
+}
+
+func listKeys(ctx context.Context, db dbtx, table string) ([]string, error) {
+	sql := fmt.Sprintf("SELECT DISTINCT name FROM %s", table)
+	rows, err := db.Query(ctx, sql)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
 	names := make([]string, 0)
 	for rows.Next() {
 		var name string
@@ -126,5 +219,28 @@ func (k *PGKeystore) List() ([]string, error) {
 		names = append(names, name)
 	}
 
-	return names, nil
+	return names, rows.Err()
+}
+
+// ctxKeystore binds a context to a PGKeystore so the bound value can be
+// passed anywhere the plain ks.Keystore interface is expected.
+type ctxKeystore struct {
+	ctx context.Context
+	k   *PGKeystore
+}
+
+func (c ctxKeystore) Has(name string) (bool, error) { return c.k.HasCtx(c.ctx, name) }
+func (c ctxKeystore) Put(name string, priv ci.PrivKey) error {
+	return c.k.PutCtx(c.ctx, name, priv)
+}
+func (c ctxKeystore) Get(name string) (ci.PrivKey, error) { return c.k.GetCtx(c.ctx, name) }
+func (c ctxKeystore) Delete(name string) error            { return c.k.DeleteCtx(c.ctx, name) }
+func (c ctxKeystore) List() ([]string, error)             { return c.k.ListCtx(c.ctx) }
+
+// WithContext binds ctx to k, returning a ks.Keystore whose methods use ctx
+// instead of context.Background() for every call. This lets callers bind a
+// request-scoped context once and pass the result wherever a plain
+// ks.Keystore is expected.
+func (k *PGKeystore) WithContext(ctx context.Context) ks.Keystore {
+	return ctxKeystore{ctx: ctx, k: k}
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	keystore "github.com/ipfs/go-ipfs-keystore"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	ci "github.com/libp2p/go-libp2p-core/crypto"
 	"os"
 	"sort"
@@ -90,13 +91,10 @@ func newKS(t *testing.T) (keystore.Keystore, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = conn.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS keys (name TEXT NOT NULL PRIMARY KEY, data BYTEA)")
-	if err != nil {
-		t.Fatal(err)
-	}
-	d, err := NewKeystore(context.Background(), connString)
+	d, err := NewKeystore(context.Background(), connString, WithAutoMigrate())
 	return d, func() {
 		_, _ = conn.Exec(context.Background(), "DROP TABLE IF EXISTS keys")
+		_, _ = conn.Exec(context.Background(), "DROP TABLE IF EXISTS keys_schema_migrations")
 		_ = conn.Close(context.Background())
 	}
 }
@@ -200,6 +198,251 @@ func TestKeystoreBasics(t *testing.T) {
 	}
 }
 
+func TestKeystoreWithPool(t *testing.T) {
+	initPG(t)
+	connString := fmt.Sprintf(
+		"postgres://%s:%s@%s/%s?sslmode=disable",
+		envString(t, "PG_USER", "postgres"),
+		envString(t, "PG_PASS", "123456"),
+		envString(t, "PG_HOST", "127.0.0.1"),
+		"test_keystore",
+	)
+	pool, err := pgxpool.Connect(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	defer func() {
+		_, _ = pool.Exec(context.Background(), "DROP TABLE IF EXISTS pooled_keys")
+		_, _ = pool.Exec(context.Background(), "DROP TABLE IF EXISTS pooled_keys_schema_migrations")
+	}()
+
+	d, err := NewKeystoreWithPool(context.Background(), pool, Table("pooled_keys"), WithAutoMigrate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.PgxPool() != pool {
+		t.Fatal("expected NewKeystoreWithPool to reuse the given pool")
+	}
+
+	k1 := privKeyOrFatal(t)
+	if err := d.Put("foo", k1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Stat().TotalConns() == 0 {
+		t.Fatal("expected Close on a borrowed pool to leave it open")
+	}
+}
+
+func TestKeystoreRotation(t *testing.T) {
+	d, done := newKS(t)
+	defer done()
+
+	pg := d.(*PGKeystore)
+
+	k1 := privKeyOrFatal(t)
+	k2 := privKeyOrFatal(t)
+
+	if err := pg.Put("rotating", k1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pg.Rotate(context.Background(), "rotating", k2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := assertGetKey(d, "rotating", k2); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := pg.GetVersion("rotating", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !old.Equals(k1) {
+		t.Fatal("expected version 1 to still be retrievable after rotation")
+	}
+
+	meta, err := pg.GetMeta("rotating")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != 2 {
+		t.Fatalf("expected active version 2, got %d", meta.Version)
+	}
+
+	active, err := pg.ListActive(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range active {
+		if n == "rotating" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected rotating to be listed as active")
+	}
+}
+
+func TestKeystoreViewAndUpdate(t *testing.T) {
+	d, done := newKS(t)
+	defer done()
+
+	pg := d.(*PGKeystore)
+
+	k1 := privKeyOrFatal(t)
+	k2 := privKeyOrFatal(t)
+
+	if err := pg.Put("alice", k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pg.Put("bob", k2); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]ci.PrivKey{}
+	err := pg.View(context.Background(), func(tx KeystoreTx) error {
+		return tx.Iterate(context.Background(), func(name string, priv ci.PrivKey) error {
+			seen[name] = priv
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || !seen["alice"].Equals(k1) || !seen["bob"].Equals(k2) {
+		t.Fatal("expected View/Iterate to see both keys with matching material")
+	}
+
+	// Update moves "bob" to "carol" atomically.
+	err = pg.Update(context.Background(), func(tx KeystoreTx) error {
+		priv, err := tx.Get(context.Background(), "bob")
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(context.Background(), "bob"); err != nil {
+			return err
+		}
+		return tx.Put(context.Background(), "carol", priv)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pg.Get("bob"); err == nil {
+		t.Fatal("expected bob to be gone after rename")
+	}
+	if err := assertGetKey(d, "carol", k2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newAESGCMEncrypter builds the same Encrypter WithAESGCM configures, for
+// tests that need to pass one directly to Rewrap.
+func newAESGCMEncrypter(t *testing.T, key []byte) Encrypter {
+	var o Options
+	if err := WithAESGCM(key)(&o); err != nil {
+		t.Fatal(err)
+	}
+	return o.Encrypter
+}
+
+func TestKeystoreRewrap(t *testing.T) {
+	d, done := newKS(t)
+	defer done()
+
+	pg := d.(*PGKeystore)
+
+	key1 := make([]byte, 32)
+	if _, err := rand.Read(key1); err != nil {
+		t.Fatal(err)
+	}
+	key2 := make([]byte, 32)
+	if _, err := rand.Read(key2); err != nil {
+		t.Fatal(err)
+	}
+	pg.encrypter = newAESGCMEncrypter(t, key1)
+
+	k1 := privKeyOrFatal(t)
+	k2 := privKeyOrFatal(t)
+	if err := pg.Put("alice", k1); err != nil {
+		t.Fatal(err)
+	}
+	// Rotate so "alice" has two rows under the same name, each wrapped with
+	// its own DEK: Rewrap must not let one overwrite the other's enc_dek.
+	if err := pg.Rotate(context.Background(), "alice", k2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pg.Rewrap(context.Background(), newAESGCMEncrypter(t, key2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := assertGetKey(d, "alice", k2); err != nil {
+		t.Fatal(err)
+	}
+	old, err := pg.GetVersion("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !old.Equals(k1) {
+		t.Fatal("expected version 1 to still decrypt correctly after Rewrap")
+	}
+}
+
+func TestKeystorePutConcurrent(t *testing.T) {
+	d, done := newKS(t)
+	defer done()
+
+	k1 := privKeyOrFatal(t)
+	k2 := privKeyOrFatal(t)
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = d.Put("racer", k1)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = d.Put("racer", k2)
+	}()
+	wg.Wait()
+
+	successes := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			successes++
+		case keystore.ErrKeyExists:
+		default:
+			t.Fatalf("unexpected error from concurrent Put: %v", err)
+		}
+	}
+	if successes != 1 {
+		t.Fatalf("expected exactly one concurrent Put to succeed, got %d", successes)
+	}
+
+	pg := d.(*PGKeystore)
+	var count int
+	err := pg.pool.QueryRow(context.Background(), fmt.Sprintf(
+		"SELECT count(*) FROM %s WHERE name = $1 AND retired_at IS NULL", pg.table,
+	), "racer").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected exactly one active row for racer, got %d", count)
+	}
+}
+
 func assertGetKey(ks keystore.Keystore, name string, exp ci.PrivKey) error {
 	outK, err := ks.Get(name)
 	if err != nil {
@@ -0,0 +1,222 @@
+package pgks
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	ks "github.com/ipfs/go-ipfs-keystore"
+	"github.com/jackc/pgx/v4"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// KeyMeta describes the lifecycle of a single stored key version: when it
+// was created, when (if ever) it expires or was retired, and which
+// rotation version it is.
+type KeyMeta struct {
+	KeyID     string
+	Version   int
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+	RetiredAt *time.Time
+}
+
+// keyRow is the subset of KeyMeta that insertKey needs to fill in before a
+// row can be written; KeyID defaults to a fresh UUID when left empty.
+type keyRow struct {
+	KeyID     string
+	Version   int
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+}
+
+// insertKey writes a new row for name, sealing skbytes first if enc is
+// non-nil. It is the shared insert path for Put, PutWithMeta and Rotate, and
+// runs against either a pool or an in-flight transaction. A concurrent
+// insert of the same active name is rejected by the partial unique index
+// added in migration 4 and surfaced here as ks.ErrKeyExists, closing the
+// race window between Put's existence check and its insert.
+func insertKey(ctx context.Context, db dbtx, table string, enc Encrypter, name string, skbytes []byte, row keyRow) error {
+	keyID := row.KeyID
+	if keyID == "" {
+		var err error
+		keyID, err = newUUID()
+		if err != nil {
+			return err
+		}
+	}
+
+	if enc == nil {
+		sql := fmt.Sprintf(
+			"INSERT INTO %s (name, data, key_id, version, created_at, expires_at) VALUES ($1, $2, $3::uuid, $4, $5, $6)",
+			table,
+		)
+		_, err := db.Exec(ctx, sql, name, skbytes, keyID, row.Version, row.CreatedAt, row.ExpiresAt)
+		if isUniqueViolation(err) {
+			return ks.ErrKeyExists
+		}
+		return err
+	}
+
+	ciphertext, nonce, wrappedDEK, err := sealPrivateKey(ctx, enc, skbytes, []byte(name))
+	if err != nil {
+		return err
+	}
+	sql := fmt.Sprintf(
+		"INSERT INTO %s (name, data, enc_dek, enc_nonce, enc_kek_id, key_id, version, created_at, expires_at) "+
+			"VALUES ($1, $2, $3, $4, $5, $6::uuid, $7, $8, $9)",
+		table,
+	)
+	_, err = db.Exec(
+		ctx, sql, name, ciphertext, wrappedDEK, nonce, kekIDFor(enc), keyID, row.Version, row.CreatedAt, row.ExpiresAt,
+	)
+	if isUniqueViolation(err) {
+		return ks.ErrKeyExists
+	}
+	return err
+}
+
+// PutWithMeta stores priv under name the same way Put does, but with
+// caller-supplied lifecycle metadata instead of the version-1,
+// never-expiring defaults. Use Rotate, not PutWithMeta, to add a later
+// version of an existing name.
+func (k *PGKeystore) PutWithMeta(name string, priv ci.PrivKey, meta KeyMeta) error {
+	ctx := context.Background()
+	skbytes, err := marshalNewKey(ctx, k.pool, k.table, name, priv)
+	if err != nil {
+		return err
+	}
+
+	version := meta.Version
+	if version == 0 {
+		version = 1
+	}
+	createdAt := meta.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+
+	return insertKey(ctx, k.pool, k.table, k.encrypter, name, skbytes, keyRow{
+		KeyID:     meta.KeyID,
+		Version:   version,
+		CreatedAt: createdAt,
+		ExpiresAt: meta.ExpiresAt,
+	})
+}
+
+// GetMeta returns the lifecycle metadata of the highest-version, non-retired
+// row stored for name, mirroring the row Get would return.
+func (k *PGKeystore) GetMeta(name string) (KeyMeta, error) {
+	sql := fmt.Sprintf(
+		"SELECT key_id, version, created_at, expires_at, retired_at FROM %s "+
+			"WHERE name = $1 AND retired_at IS NULL ORDER BY version DESC LIMIT 1",
+		k.table,
+	)
+	row := k.pool.QueryRow(context.Background(), sql, name)
+	var meta KeyMeta
+	switch err := row.Scan(&meta.KeyID, &meta.Version, &meta.CreatedAt, &meta.ExpiresAt, &meta.RetiredAt); err {
+	case pgx.ErrNoRows:
+		return KeyMeta{}, ks.ErrNoSuchKey
+	case nil:
+		return meta, nil
+	default:
+		return KeyMeta{}, err
+	}
+}
+
+// GetVersion returns the private key stored for name at exactly version,
+// including retired versions, so callers can still verify signatures made
+// with a key that has since been rotated out.
+func (k *PGKeystore) GetVersion(name string, version int) (ci.PrivKey, error) {
+	sql := fmt.Sprintf("SELECT data, enc_dek, enc_nonce FROM %s WHERE name = $1 AND version = $2", k.table)
+	row := k.pool.QueryRow(context.Background(), sql, name, version)
+	var data, encDEK, encNonce []byte
+	switch err := row.Scan(&data, &encDEK, &encNonce); err {
+	case pgx.ErrNoRows:
+		return nil, ks.ErrNoSuchKey
+	case nil:
+		return decryptRow(context.Background(), k.encrypter, name, data, encDEK, encNonce)
+	default:
+		return nil, err
+	}
+}
+
+// Rotate adds newPriv to name as the next version and retires the
+// previously active version, all inside one transaction so Get never
+// observes a name with no active version.
+func (k *PGKeystore) Rotate(ctx context.Context, name string, newPriv ci.PrivKey) error {
+	skbytes, err := ci.MarshalPrivateKey(newPriv)
+	if err != nil {
+		return err
+	}
+
+	// FOR UPDATE locks the active row so two concurrent Rotate calls for the
+	// same name can't both read it before either retires it, which would
+	// otherwise leave two active versions after both commit.
+	return k.pool.BeginTxFunc(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		row := tx.QueryRow(ctx, fmt.Sprintf(
+			"SELECT version FROM %s WHERE name = $1 AND retired_at IS NULL ORDER BY version DESC LIMIT 1 FOR UPDATE", k.table,
+		), name)
+		var prevVersion int
+		switch err := row.Scan(&prevVersion); err {
+		case pgx.ErrNoRows:
+			return ks.ErrNoSuchKey
+		case nil:
+		default:
+			return err
+		}
+
+		retireSQL := fmt.Sprintf("UPDATE %s SET retired_at = now() WHERE name = $1 AND version = $2", k.table)
+		if _, err := tx.Exec(ctx, retireSQL, name, prevVersion); err != nil {
+			return err
+		}
+
+		return insertKey(ctx, tx, k.table, k.encrypter, name, skbytes, keyRow{Version: prevVersion + 1, CreatedAt: time.Now()})
+	})
+}
+
+// ListActive returns the names of keys that have an active version: not
+// retired, and not past their expiry if one is set.
+func (k *PGKeystore) ListActive(ctx context.Context) ([]string, error) {
+	sql := fmt.Sprintf(
+		"SELECT DISTINCT name FROM %s WHERE retired_at IS NULL AND (expires_at IS NULL OR expires_at > now())",
+		k.table,
+	)
+	rows, err := k.pool.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GC permanently deletes rows that were retired more than olderThan ago,
+// reclaiming storage for keys that have been rotated out and are no longer
+// needed for historical signature verification.
+func (k *PGKeystore) GC(ctx context.Context, olderThan time.Duration) error {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE retired_at IS NOT NULL AND retired_at < $1", k.table)
+	_, err := k.pool.Exec(ctx, sql, time.Now().Add(-olderThan))
+	return err
+}
+
+// newUUID generates a random version-4 UUID without depending on a
+// database-side extension like pgcrypto.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,197 @@
+package pgks
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// migration is a single versioned schema change applied in order by Migrate.
+// Most versions are a plain sql statement; a version that needs per-row Go
+// logic (e.g. generating UUIDs without a database-side extension) also sets
+// fn, which runs against the same transaction immediately after sql.
+type migration struct {
+	version int
+	sql     func(table string) string
+	fn      func(ctx context.Context, tx pgx.Tx, table string) error
+}
+
+// migrations holds the ordered set of schema changes for a keystore table.
+// Later versions are appended here as the schema grows; existing versions
+// must never be edited once released.
+var migrations = []migration{
+	{
+		version: 1,
+		sql: func(table string) string {
+			return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name TEXT NOT NULL PRIMARY KEY, data BYTEA)", table)
+		},
+	},
+	{
+		version: 2,
+		sql: func(table string) string {
+			return fmt.Sprintf(
+				"ALTER TABLE %s ADD COLUMN IF NOT EXISTS enc_dek BYTEA, ADD COLUMN IF NOT EXISTS enc_nonce BYTEA, ADD COLUMN IF NOT EXISTS enc_kek_id TEXT",
+				table,
+			)
+		},
+	},
+	{
+		// Moves the schema from a flat name->bytes map to a rotating,
+		// versioned store: name is no longer unique on its own, so the
+		// original name-only primary key is dropped in favor of key_id.
+		// key_id itself is backfilled from Go by fn, using the same
+		// dependency-free newUUID generator Put/Rotate use, rather than the
+		// pgcrypto-only gen_random_uuid().
+		version: 3,
+		sql: func(table string) string {
+			base := baseTableName(table)
+			return fmt.Sprintf(`
+ALTER TABLE %[1]s DROP CONSTRAINT IF EXISTS %[2]s_pkey;
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS key_id UUID;
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS retired_at TIMESTAMPTZ;
+`, table, base)
+		},
+		fn: backfillKeyIDs,
+	},
+	{
+		// Enforces "at most one active row per name" at the database level,
+		// so Put/PutWithMeta can translate a unique violation into
+		// ks.ErrKeyExists instead of racing an unguarded SELECT + INSERT.
+		version: 4,
+		sql: func(table string) string {
+			base := baseTableName(table)
+			return fmt.Sprintf(
+				"CREATE UNIQUE INDEX IF NOT EXISTS %[2]s_active_name_idx ON %[1]s (name) WHERE retired_at IS NULL",
+				table, base,
+			)
+		},
+	},
+}
+
+// backfillKeyIDs assigns a fresh key_id to every pre-existing row left over
+// from before version 3 added the column, then finalizes it as the table's
+// primary key. Rows are matched by name: version 3's sql has already dropped
+// the name primary key, but every pre-existing row still has a distinct name
+// at this point in the migration sequence.
+func backfillKeyIDs(ctx context.Context, tx pgx.Tx, table string) error {
+	rows, err := tx.Query(ctx, fmt.Sprintf("SELECT name FROM %s WHERE key_id IS NULL FOR UPDATE", table))
+	if err != nil {
+		return fmt.Errorf("selecting rows to backfill key_id: %w", err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	updateSQL := fmt.Sprintf("UPDATE %s SET key_id = $1::uuid WHERE name = $2 AND key_id IS NULL", table)
+	for _, name := range names {
+		id, err := newUUID()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, updateSQL, id, name); err != nil {
+			return fmt.Errorf("backfilling key_id for %q: %w", name, err)
+		}
+	}
+
+	base := baseTableName(table)
+	finalizeSQL := fmt.Sprintf(`
+ALTER TABLE %[1]s ALTER COLUMN key_id SET NOT NULL;
+ALTER TABLE %[1]s ADD PRIMARY KEY (key_id);
+CREATE INDEX IF NOT EXISTS %[2]s_name_idx ON %[1]s (name);
+`, table, base)
+	_, err = tx.Exec(ctx, finalizeSQL)
+	return err
+}
+
+// Migrate brings table up to the latest schema version, recording applied
+// versions in "<table>_schema_migrations". It takes a Postgres advisory
+// transaction lock keyed on table so that multiple processes starting
+// concurrently don't race to apply the same version twice.
+func Migrate(ctx context.Context, pool *pgxpool.Pool, table string) error {
+	return pool.BeginTxFunc(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", advisoryLockKey(table)); err != nil {
+			return fmt.Errorf("acquiring migration lock: %w", err)
+		}
+
+		migTable := table + "_schema_migrations"
+		createSQL := fmt.Sprintf(
+			"CREATE TABLE IF NOT EXISTS %s (version INT PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())",
+			migTable,
+		)
+		if _, err := tx.Exec(ctx, createSQL); err != nil {
+			return fmt.Errorf("creating migrations table: %w", err)
+		}
+
+		applied := make(map[int]bool)
+		rows, err := tx.Query(ctx, fmt.Sprintf("SELECT version FROM %s", migTable))
+		if err != nil {
+			return fmt.Errorf("reading applied migrations: %w", err)
+		}
+		for rows.Next() {
+			var v int
+			if err := rows.Scan(&v); err != nil {
+				rows.Close()
+				return err
+			}
+			applied[v] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if applied[m.version] {
+				continue
+			}
+			if _, err := tx.Exec(ctx, m.sql(table)); err != nil {
+				return fmt.Errorf("applying migration %d: %w", m.version, err)
+			}
+			if m.fn != nil {
+				if err := m.fn(ctx, tx, table); err != nil {
+					return fmt.Errorf("applying migration %d: %w", m.version, err)
+				}
+			}
+			insertSQL := fmt.Sprintf("INSERT INTO %s (version) VALUES ($1)", migTable)
+			if _, err := tx.Exec(ctx, insertSQL, m.version); err != nil {
+				return fmt.Errorf("recording migration %d: %w", m.version, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// advisoryLockKey derives a stable pg_advisory_xact_lock key from table, so
+// that migrations against different tables don't contend on the same lock.
+func advisoryLockKey(table string) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(table))
+	return int64(h.Sum64())
+}
+
+// baseTableName strips a "schema." qualifier from table, since Postgres
+// constraint and index names are never schema-qualified themselves.
+func baseTableName(table string) string {
+	if idx := strings.LastIndex(table, "."); idx >= 0 {
+		return table[idx+1:]
+	}
+	return table
+}
@@ -6,7 +6,20 @@ import (
 
 // Options are Keystore options
 type Options struct {
-	Table string
+	Table         string
+	Schema        string
+	AutoMigrate   bool
+	Encrypter     Encrypter
+	UpdateRetries int
+}
+
+// QualifiedTable returns the table name to use in generated SQL: Table
+// qualified with Schema, if one was configured with WithSchema.
+func (o Options) QualifiedTable() string {
+	if o.Schema == "" {
+		return o.Table
+	}
+	return fmt.Sprintf("%s.%s", o.Schema, o.Table)
 }
 
 // Option is the PGKeystore option type.
@@ -26,6 +39,7 @@ func (o *Options) Apply(opts ...Option) error {
 // prepended to any options you pass to the Hydra Head constructor.
 var OptionDefaults = func(o *Options) error {
 	o.Table = "keys"
+	o.UpdateRetries = 3
 	return nil
 }
 
@@ -39,3 +53,35 @@ func Table(t string) Option {
 		return nil
 	}
 }
+
+// WithAutoMigrate makes NewKeystore run Migrate against the configured table
+// before returning, so the caller doesn't need a separate migration step.
+func WithAutoMigrate() Option {
+	return func(o *Options) error {
+		o.AutoMigrate = true
+		return nil
+	}
+}
+
+// WithSchema qualifies the configured table as "schema.table" in every
+// generated SQL statement, including migrations, so the keystore can live in
+// a dedicated Postgres schema alongside an unrelated application database.
+func WithSchema(name string) Option {
+	return func(o *Options) error {
+		o.Schema = name
+		return nil
+	}
+}
+
+// WithUpdateRetries configures how many times Update retries its callback,
+// in a fresh transaction, after a Postgres serialization failure. Defaults
+// to 3.
+func WithUpdateRetries(n int) Option {
+	return func(o *Options) error {
+		if n < 0 {
+			return fmt.Errorf("update retries must be >= 0, got %d", n)
+		}
+		o.UpdateRetries = n
+		return nil
+	}
+}
@@ -0,0 +1,136 @@
+package pgks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	ci "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+// KeystoreTx exposes keystore operations bound to a single pgx.Tx, so code
+// running inside View or Update observes one consistent transaction instead
+// of racing with concurrent Puts, Deletes or Rotates.
+type KeystoreTx interface {
+	Has(ctx context.Context, name string) (bool, error)
+	Get(ctx context.Context, name string) (ci.PrivKey, error)
+	List(ctx context.Context) ([]string, error)
+	Iterate(ctx context.Context, fn func(name string, priv ci.PrivKey) error) error
+	Put(ctx context.Context, name string, priv ci.PrivKey) error
+	Delete(ctx context.Context, name string) error
+}
+
+// txKeystore implements KeystoreTx by running the same query helpers
+// PGKeystore uses, against tx instead of the pool.
+type txKeystore struct {
+	table     string
+	tx        pgx.Tx
+	encrypter Encrypter
+}
+
+func (t txKeystore) Has(ctx context.Context, name string) (bool, error) {
+	return hasKey(ctx, t.tx, t.table, name)
+}
+
+func (t txKeystore) Get(ctx context.Context, name string) (ci.PrivKey, error) {
+	return getKey(ctx, t.tx, t.table, t.encrypter, name)
+}
+
+func (t txKeystore) List(ctx context.Context) ([]string, error) {
+	return listKeys(ctx, t.tx, t.table)
+}
+
+func (t txKeystore) Put(ctx context.Context, name string, priv ci.PrivKey) error {
+	skbytes, err := marshalNewKey(ctx, t.tx, t.table, name, priv)
+	if err != nil {
+		return err
+	}
+	return insertKey(ctx, t.tx, t.table, t.encrypter, name, skbytes, keyRow{Version: 1, CreatedAt: time.Now()})
+}
+
+func (t txKeystore) Delete(ctx context.Context, name string) error {
+	return deleteKey(ctx, t.tx, t.table, name)
+}
+
+// Iterate streams every active, non-retired key in the transaction's
+// snapshot to fn via Query + rows.Next(), so listing millions of keys
+// doesn't materialize them all in memory at once.
+func (t txKeystore) Iterate(ctx context.Context, fn func(name string, priv ci.PrivKey) error) error {
+	sql := fmt.Sprintf(
+		"SELECT DISTINCT ON (name) name, data, enc_dek, enc_nonce FROM %s "+
+			"WHERE retired_at IS NULL ORDER BY name, version DESC",
+		t.table,
+	)
+	rows, err := t.tx.Query(ctx, sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var data, encDEK, encNonce []byte
+		if err := rows.Scan(&name, &data, &encDEK, &encNonce); err != nil {
+			return err
+		}
+		priv, err := decryptRow(ctx, t.encrypter, name, data, encDEK, encNonce)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, priv); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// View opens a true Postgres snapshot — a Serializable, read-only,
+// deferrable transaction — and runs fn against a KeystoreTx bound to it, so
+// a bulk export or backup observes one consistent point in time instead of
+// racing with concurrent Puts, Deletes or Rotates.
+func (k *PGKeystore) View(ctx context.Context, fn func(tx KeystoreTx) error) error {
+	return k.pool.BeginTxFunc(ctx, pgx.TxOptions{
+		IsoLevel:       pgx.Serializable,
+		AccessMode:     pgx.ReadOnly,
+		DeferrableMode: pgx.Deferrable,
+	}, func(tx pgx.Tx) error {
+		return fn(txKeystore{table: k.table, tx: tx, encrypter: k.encrypter})
+	})
+}
+
+// Update runs fn against a KeystoreTx bound to a read-write Serializable
+// transaction, so a sequence of Puts/Deletes (e.g. a rename) commits
+// atomically. If Postgres reports a serialization failure (error code
+// 40001), it retries fn in a fresh transaction, up to k's configured
+// WithUpdateRetries bound.
+func (k *PGKeystore) Update(ctx context.Context, fn func(tx KeystoreTx) error) error {
+	var err error
+	for attempt := 0; attempt <= k.updateRetries; attempt++ {
+		err = k.pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.Serializable}, func(tx pgx.Tx) error {
+			return fn(txKeystore{table: k.table, tx: tx, encrypter: k.encrypter})
+		})
+		if err == nil || !isSerializationFailure(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// isSerializationFailure reports whether err is Postgres error 40001,
+// serialization_failure, the error Serializable transactions return when
+// they lose a conflict and must be retried.
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40001"
+}
+
+// isUniqueViolation reports whether err is Postgres error 23505,
+// unique_violation, e.g. from the partial unique index that enforces at
+// most one active row per name.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}